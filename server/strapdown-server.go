@@ -2,6 +2,8 @@ package main
 
 import (
 	"bytes"
+	"container/list"
+	"crypto/sha1"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
@@ -9,6 +11,7 @@ import (
 	"fmt"
 	auth "github.com/abbot/go-http-auth"
 	"github.com/libgit2/git2go"
+	"golang.org/x/sync/singleflight"
 	"html/template"
 	"io"
 	"io/ioutil"
@@ -21,6 +24,7 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -33,6 +37,9 @@ var default_heading_number = flag.String("heading_number", "false", "set default
 var default_title = flag.String("title", "Wiki", "default title for wiki pages")
 var default_theme = flag.String("theme", "cerulean", "default theme for strapdown")
 var default_histsize = flag.Int("histsize", 30, "default history size")
+var default_cachesize = flag.Int("cachesize", 0, "max number of rendered pages kept in the render cache, 0 to disable the cache")
+var static_dir = flag.String("static_dir", "", "directory to keep prebuilt html of edited pages, served directly while fresh, empty to disable")
+var default_coalesce = flag.Bool("coalesce", true, "let concurrent renders of the same page share a single render")
 
 type DirEntry struct {
 	Urlpath string
@@ -102,6 +109,74 @@ func (config *Config) FillDefault(content []byte) {
 	}
 }
 
+// RenderCache is a bounded LRU cache of rendered pages, keyed by render_cache_key
+type RenderCache struct {
+	mu    sync.Mutex
+	size  int
+	ll    *list.List
+	items map[string]*list.Element
+}
+
+type renderCacheEntry struct {
+	key   string
+	value []byte
+}
+
+func NewRenderCache(size int) *RenderCache {
+	return &RenderCache{size: size, ll: list.New(), items: make(map[string]*list.Element)}
+}
+
+func (this *RenderCache) Get(key string) ([]byte, bool) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if e, ok := this.items[key]; ok {
+		this.ll.MoveToFront(e)
+		return e.Value.(*renderCacheEntry).value, true
+	}
+	return nil, false
+}
+
+func (this *RenderCache) Add(key string, value []byte) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if e, ok := this.items[key]; ok {
+		this.ll.MoveToFront(e)
+		e.Value.(*renderCacheEntry).value = value
+		return
+	}
+	this.items[key] = this.ll.PushFront(&renderCacheEntry{key: key, value: value})
+	for this.ll.Len() > this.size {
+		e := this.ll.Back()
+		this.ll.Remove(e)
+		delete(this.items, e.Value.(*renderCacheEntry).key)
+	}
+}
+
+// the same markdown renders differently under different profiles, themes and options,
+// so the key is made of the git blob sha of content, the profile, the theme and a hash of everything else
+func render_cache_key(content []byte, profile string, theme string, extra ...[]byte) string {
+	blob := sha1.New()
+	fmt.Fprintf(blob, "blob %d\x00", len(content))
+	blob.Write(content)
+	conf := sha1.New()
+	for _, e := range extra {
+		fmt.Fprintf(conf, "%d\x00", len(e))
+		conf.Write(e)
+	}
+	return fmt.Sprintf("%x:%s:%s:%x", blob.Sum(nil), profile, theme, conf.Sum(nil))
+}
+
+var renderCache *RenderCache
+var renderGroup singleflight.Group
+
+// bump static_format whenever the layout of prebuilt pages or the head/tail assembly changes
+const static_format = "strapdown-static-1"
+
+// prebuilt pages carry static_version, so pages built with another view template or defaults get rebuilt
+var static_version string
+
+const viewTemplateSource = "<!DOCTYPE html> <html> <title>{{.Title}}</title> <meta charset=\"utf-8\"> <xmp theme=\"{{.Theme}}\" toc=\"{{.Toc}}\" heading_number=\"{{.HeadingNumber}}\" style=\"display:none;\">\n{{.Content}}\n</xmp> <script src=\"http://{{.Host}}/strapdown/strapdown.min.js\"></script> </html>\n"
+
 var viewTemplate, editTemplate, listdirTemplate, historyTemplate, diffTemplate *template.Template
 var authenticator *auth.BasicAuth
 
@@ -115,10 +190,25 @@ func init_after_main() { // init after main because we need to chdir first, then
 		log.Printf("authentication file not exist, disable http authentication")
 	}
 
-	viewTemplate, err = template.New("view").Parse("<!DOCTYPE html> <html> <title>{{.Title}}</title> <meta charset=\"utf-8\"> <xmp theme=\"{{.Theme}}\" toc=\"{{.Toc}}\" heading_number=\"{{.HeadingNumber}}\" style=\"display:none;\">\n{{.Content}}\n</xmp> <script src=\"http://{{.Host}}/strapdown/strapdown.min.js\"></script> </html>\n")
+	if len(*static_dir) > 0 {
+		if err := check_static_dir(*static_dir); err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("serve prebuilt pages from %s", *static_dir)
+	}
+
+	if *default_cachesize > 0 {
+		renderCache = NewRenderCache(*default_cachesize)
+		log.Printf("render cache enabled, size %d", *default_cachesize)
+	}
+
+	viewTemplate, err = template.New("view").Parse(viewTemplateSource)
 	if err != nil {
 		log.Fatalf("cannot parse view template")
 	}
+	version := sha1.New()
+	fmt.Fprintf(version, "%s\x00%s\x00%s\x00%s\x00%s\x00%s", static_format, viewTemplateSource, *default_title, *default_theme, *default_heading_number, *default_host)
+	static_version = fmt.Sprintf("%x", version.Sum(nil))
 	editTemplate, err = template.New("edit").Parse("<!DOCTYPE html><html lang=\"en\"><head><meta charset=\"UTF-8\"><meta http-equiv=\"X-UA-Compatible\" content=\"IE=edge,chrome=1\"><title>{{.Title}}</title><link rel=\"stylesheet\" href=\"http://{{.Host}}/strapdown/themes/cerulean.min.css\" /><style type=\"text/css\" media=\"screen\">html, body {height: 100%;overflow: hidden;margin: 0;padding: 0;}#editor {margin: 0;position: absolute;top: 51px;bottom: 0;left: 0;right: 0;}</style></head><body><div class=\"navbar navbar-fixed-top\"><div class=\"navbar-inner\"><div style=\"padding:0 20px\"><a class=\"btn btn-navbar\" data-toggle=\"collapse\" data-target=\".navbar-responsive-collapse\"><span class=\"icon-bar\"></span><span class=\"icon-bar\"></span><span class=\"icon-bar\"></span></a><div id=\"headline\" class=\"brand\"> {{.Title}} </div><div class=\"nav-collapse collapse navbar-responsive-collapse pull-right\"> <form class=\"nav\" method=\"POST\" action=\"?edit\" name=\"body\"><input id=\"savValue\" type=\"hidden\" name=\"body\" value=\"\" /><button class=\"btn btn-default btn-sm\" type=\"submit\">Save</button></form></div></div> </div></div><xmp id=\"editor\">{{.Content}}</xmp><script src=\"http://{{.Host}}/ace/ace.js\" type=\"text/javascript\" charset=\"utf-8\"></script><script src=\"http://{{.Host}}/strapdown/edit.js\" type=\"text/javascript\" charset=\"utf-8\"></script></body></html>\n")
 	if err != nil {
 		log.Fatalf("cannot parse edit template")
@@ -488,9 +578,132 @@ func save_and_commit(fp string, content []byte, comment string, author string) e
 	if err != nil {
 		return err
 	}
+
+	if len(*static_dir) > 0 && strings.HasSuffix(fp, ".md") {
+		// the commit is done, a failed build only means the page is rendered on the fly
+		if err := build_static(fp); err != nil {
+			log.Printf("[ WARN ] cannot build static page for %s: %v", fp, err)
+		}
+	}
 	return nil
 }
 
+func static_path(fpmd string) string {
+	return filepath.Join(*static_dir, filepath.FromSlash(path.Clean("/"+fpmd+".html")))
+}
+
+// prebuilt pages live outside the wiki root, otherwise they show up in listings and as raw files
+func check_static_dir(dir string) error {
+	wikiroot, err := filepath.Abs(".")
+	if err != nil {
+		return err
+	}
+	staticroot, err := filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+	rel, err := filepath.Rel(wikiroot, staticroot)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return nil
+	}
+	return fmt.Errorf("static directory %s should be outside the wiki root %s", staticroot, wikiroot)
+}
+
+// the stamp of fpmd is made of static_version and the mtime and size of the markdown and its view options,
+// taken before the markdown is read, so a prebuilt page never claims content newer than it was rendered from
+func static_stamp(fpmd string) (string, error) {
+	stamp := static_version
+	for _, dep := range []string{fpmd, fpmd + ".option.json", fpmd + ".head", fpmd + ".tail"} {
+		depstat, err := os.Stat(dep)
+		if err != nil {
+			if os.IsNotExist(err) && dep != fpmd {
+				stamp += " -"
+				continue
+			}
+			return "", err
+		}
+		stamp += fmt.Sprintf(" %d:%d", depstat.ModTime().UnixNano(), depstat.Size())
+	}
+	return stamp, nil
+}
+
+// render the view page of fpmd from disk into static_dir
+func build_static(fpmd string) error {
+	stamp, err := static_stamp(fpmd)
+	if err != nil {
+		return err
+	}
+	content, err := ioutil.ReadFile(fpmd)
+	if err != nil {
+		return err
+	}
+	page, err := render_page(view_renderer(fpmd, content))
+	if err != nil {
+		return err
+	}
+	return write_static(fpmd, stamp, page)
+}
+
+// wrap render to also write the prebuilt page, so only the goroutine which actually renders writes it
+func static_renderer(fpmd string, stamp string, render func() ([]byte, error)) func() ([]byte, error) {
+	return func() ([]byte, error) {
+		page, err := render()
+		if err == nil {
+			if err := write_static(fpmd, stamp, page); err != nil {
+				log.Printf("[ WARN ] cannot build static page for %s: %v", fpmd, err)
+			}
+		}
+		return page, err
+	}
+}
+
+// a prebuilt page starts with the stamp it was built with, followed by a newline
+func write_static(fpmd string, stamp string, page []byte) error {
+	sp := static_path(fpmd)
+	err := os.MkdirAll(filepath.Dir(sp), 0755)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(sp), ".build-")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write([]byte(stamp + "\n"))
+	if err == nil {
+		_, err = tmp.Write(page)
+	}
+	if err2 := tmp.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), sp)
+}
+
+// serve the prebuilt page of fpmd if it was built with stamp
+func serve_static(w http.ResponseWriter, r *http.Request, fpmd string, stamp string) bool {
+	sp := static_path(fpmd)
+	spfile, err := os.Open(sp)
+	if err != nil {
+		return false
+	}
+	defer spfile.Close()
+	spstat, err := spfile.Stat()
+	if err != nil || spstat.IsDir() {
+		return false
+	}
+	header := make([]byte, len(stamp)+1)
+	if _, err = io.ReadFull(spfile, header); err != nil || string(header) != stamp+"\n" {
+		return false
+	}
+	offset := int64(len(header))
+	// no name given, so the content type is sniffed just like a rendered page
+	http.ServeContent(w, r, "", spstat.ModTime(), io.NewSectionReader(spfile, offset, spstat.Size()-offset))
+	return true
+}
+
 func remote_ip(r *http.Request) string {
 	ret := r.RemoteAddr
 	i := strings.IndexByte(ret, ':')
@@ -1058,6 +1271,17 @@ func handle(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// only the stamp is checked for a prebuilt page, the markdown is read and rendered on a miss
+	var stamp string
+	if len(*static_dir) > 0 && !doversion && !doedit && r.Method == "GET" {
+		stamp, err = static_stamp(fpmd)
+		if err != nil {
+			stamp = ""
+		} else if serve_static(w, r, fpmd, stamp) {
+			return
+		}
+	}
+
 	if doversion {
 		content, err = getFileOfVersion(fpmd, version)
 		if err != nil {
@@ -1091,24 +1315,82 @@ func handle(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	key, render := view_renderer(fpmd, content)
+	if len(stamp) > 0 {
+		// prebuilt page is missing or stale, rebuild it along with the render
+		render = static_renderer(fpmd, stamp, render)
+	}
+	page, _ := render_page(key, render)
+	w.Write(page)
+}
+
+// the render cache key and the render function of the view page of fpmd with content
+func view_renderer(fpmd string, content []byte) (string, func() ([]byte, error)) {
+	var key string
+	var render func() ([]byte, error)
+
 	custom_view_head, errh := ioutil.ReadFile(fpmd + ".head")
 	custom_view_tail, errt := ioutil.ReadFile(fpmd + ".tail")
 	if errh == nil && errt == nil {
-		w.Write(custom_view_head)
-		w.Write(content)
-		w.Write(custom_view_tail)
+		key = render_cache_key(content, "headtail", "", custom_view_head, custom_view_tail)
+		render = func() ([]byte, error) {
+			buffer := &bytes.Buffer{}
+			buffer.Write(custom_view_head)
+			buffer.Write(content)
+			buffer.Write(custom_view_tail)
+			return buffer.Bytes(), nil
+		}
 	} else {
 		custom_view_option, errv := ioutil.ReadFile(fpmd + ".option.json")
 		var config Config = Config{}
 		if errv == nil {
 			json.Unmarshal(custom_view_option, &config)
 		}
+		config.FillDefault(nil)
+		config_json, _ := json.Marshal(config)
+		key = render_cache_key(content, "view", config.Theme, config_json)
 		config.FillDefault(content)
-		err = viewTemplate.Execute(w, config)
-		if err != nil {
-			log.Printf("[ ERR ] fill view template error: %v", err)
+		render = func() ([]byte, error) {
+			buffer := &bytes.Buffer{}
+			err := viewTemplate.Execute(buffer, config)
+			if err != nil {
+				log.Printf("[ ERR ] fill view template error: %v", err)
+			}
+			return buffer.Bytes(), err
+		}
+	}
+
+	return key, render
+}
+
+// render a page with render, using the render cache if enabled
+func render_page(key string, render func() ([]byte, error)) ([]byte, error) {
+	if renderCache != nil {
+		if page, ok := renderCache.Get(key); ok {
+			return page, nil
 		}
 	}
+	fill := func() ([]byte, error) {
+		// a render of the same key may have just finished and filled the cache
+		if renderCache != nil {
+			if page, ok := renderCache.Get(key); ok {
+				return page, nil
+			}
+		}
+		page, err := render()
+		if err == nil && renderCache != nil {
+			renderCache.Add(key, page)
+		}
+		return page, err
+	}
+	if !*default_coalesce {
+		return fill()
+	}
+	// only one goroutine renders a key at a time, the others wait and share its result
+	page, err, _ := renderGroup.Do(key, func() (interface{}, error) {
+		return fill()
+	})
+	return page.([]byte), err
 }
 
 func main() {
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"github.com/libgit2/git2go"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRenderCacheKey(t *testing.T) {
+	base := render_cache_key([]byte("# hi"), "view", "cerulean", []byte(`{"Theme":"cerulean"}`))
+	cases := []struct {
+		name string
+		key  string
+		same bool
+	}{
+		{"identical", render_cache_key([]byte("# hi"), "view", "cerulean", []byte(`{"Theme":"cerulean"}`)), true},
+		{"content", render_cache_key([]byte("# ho"), "view", "cerulean", []byte(`{"Theme":"cerulean"}`)), false},
+		{"theme", render_cache_key([]byte("# hi"), "view", "cosmo", []byte(`{"Theme":"cerulean"}`)), false},
+		{"profile", render_cache_key([]byte("# hi"), "headtail", "cerulean", []byte(`{"Theme":"cerulean"}`)), false},
+		{"option", render_cache_key([]byte("# hi"), "view", "cerulean", []byte(`{"Theme":"cerulean","Toc":true}`)), false},
+		{"no option", render_cache_key([]byte("# hi"), "view", "cerulean"), false},
+	}
+	for _, c := range cases {
+		if (c.key == base) != c.same {
+			t.Errorf("%s: key %s, base %s, expect same=%v", c.name, c.key, base, c.same)
+		}
+	}
+
+	// head and tail must not be interchangeable by moving bytes across the boundary
+	splits := []struct {
+		head, tail string
+	}{
+		{"<a>", "</a>"},
+		{"<a></a", ">"},
+		{"a\x00", "b"},
+		{"a", "\x00b"},
+	}
+	seen := make(map[string]int)
+	for i, c := range splits {
+		key := render_cache_key([]byte("x"), "headtail", "", []byte(c.head), []byte(c.tail))
+		if j, ok := seen[key]; ok {
+			t.Errorf("head/tail split %q+%q has the same key as %q+%q", c.head, c.tail, splits[j].head, splits[j].tail)
+		}
+		seen[key] = i
+	}
+}
+
+func TestRenderCacheEviction(t *testing.T) {
+	cache := NewRenderCache(2)
+	cache.Add("a", []byte("A"))
+	cache.Add("b", []byte("B"))
+	if _, ok := cache.Get("a"); !ok { // a is now most recently used
+		t.Fatalf("a should be cached")
+	}
+	cache.Add("c", []byte("C"))
+	if _, ok := cache.Get("b"); ok {
+		t.Errorf("b should be evicted as least recently used")
+	}
+	for _, k := range []string{"a", "c"} {
+		if _, ok := cache.Get(k); !ok {
+			t.Errorf("%s should be cached", k)
+		}
+	}
+	if cache.ll.Len() != 2 || len(cache.items) != 2 {
+		t.Errorf("cache holds %d/%d entries, expect 2", cache.ll.Len(), len(cache.items))
+	}
+
+	cache.Add("a", []byte("A2"))
+	if v, _ := cache.Get("a"); string(v) != "A2" {
+		t.Errorf("a = %q, expect A2", v)
+	}
+	if cache.ll.Len() != 2 {
+		t.Errorf("re-adding a key should not grow the cache, got %d", cache.ll.Len())
+	}
+}
+
+// chdir into a fresh wiki with its static_dir next to it, both under a temp dir
+func setupStaticWiki(t *testing.T) func() {
+	dir, err := ioutil.TempDir("", "strapdown")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cwd, _ := os.Getwd()
+	saved_static_dir := *static_dir
+	wiki := filepath.Join(dir, "wiki")
+	os.MkdirAll(wiki, 0755)
+	os.Chdir(wiki)
+	*static_dir = filepath.Join(dir, "static")
+	init_after_main()
+	return func() {
+		os.Chdir(cwd)
+		*static_dir = saved_static_dir
+		os.RemoveAll(dir)
+	}
+}
+
+func get(path string, method string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	handle(rec, httptest.NewRequest(method, path, nil))
+	return rec
+}
+
+func TestStaticPath(t *testing.T) {
+	defer func(dir string) { *static_dir = dir }(*static_dir)
+	*static_dir = "/srv/static"
+	cases := map[string]string{
+		"a.md":          "/srv/static/a.md.html",
+		"dir/a.md":      "/srv/static/dir/a.md.html",
+		"../../a.md":    "/srv/static/a.md.html",
+		"dir/../../.md": "/srv/static/.md.html",
+		".md":           "/srv/static/.md.html",
+	}
+	for fpmd, expect := range cases {
+		if sp := static_path(fpmd); sp != filepath.FromSlash(expect) {
+			t.Errorf("static_path(%q) = %q, expect %q", fpmd, sp, expect)
+		}
+	}
+}
+
+func TestCheckStaticDir(t *testing.T) {
+	defer setupStaticWiki(t)()
+	cases := map[string]bool{
+		"../static":     true,
+		"../wiki2":      true,
+		*static_dir:     true,
+		".":             false,
+		"static":        false,
+		"a/../static":   false,
+		"../wiki/cache": false,
+	}
+	for dir, ok := range cases {
+		if err := check_static_dir(dir); (err == nil) != ok {
+			t.Errorf("check_static_dir(%q) = %v, expect ok=%v", dir, err, ok)
+		}
+	}
+}
+
+func TestServeStatic(t *testing.T) {
+	defer setupStaticWiki(t)()
+	ioutil.WriteFile("a.md", []byte("# hi"), 0644)
+	stamp, err := static_stamp("a.md")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = write_static("a.md", stamp, []byte("<html>prebuilt</html>")); err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ioutil.ReadFile(static_path("a.md"))
+	if string(b) != stamp+"\n<html>prebuilt</html>" {
+		t.Errorf("prebuilt file is %q", b)
+	}
+
+	rec := httptest.NewRecorder()
+	if !serve_static(rec, httptest.NewRequest("GET", "/a", nil), "a.md", stamp) {
+		t.Fatalf("prebuilt page not served")
+	}
+	if rec.Body.String() != "<html>prebuilt</html>" {
+		t.Errorf("served %q, expect the page without the stamp", rec.Body.String())
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "text/html; charset=utf-8" {
+		t.Errorf("served content type %q", ct)
+	}
+	if serve_static(httptest.NewRecorder(), httptest.NewRequest("GET", "/a", nil), "a.md", stamp+"x") {
+		t.Errorf("prebuilt page served with a stale stamp")
+	}
+}
+
+func TestStaticStamp(t *testing.T) {
+	defer setupStaticWiki(t)()
+	if _, err := static_stamp("a.md"); err == nil {
+		t.Errorf("stamp of a missing page should fail")
+	}
+	ioutil.WriteFile("a.md", []byte("# hi"), 0644)
+	stamp, _ := static_stamp("a.md")
+	for _, dep := range []string{"a.md.option.json", "a.md.head", "a.md.tail"} {
+		ioutil.WriteFile(dep, []byte("{}"), 0644)
+		added, _ := static_stamp("a.md")
+		os.Remove(dep)
+		removed, _ := static_stamp("a.md")
+		if added == stamp || removed != stamp {
+			t.Errorf("%s: stamp should change when it appears and change back when it is gone", dep)
+		}
+	}
+	ioutil.WriteFile("a.md", []byte("# hello"), 0644)
+	if changed, _ := static_stamp("a.md"); changed == stamp {
+		t.Errorf("stamp should change with the markdown")
+	}
+	saved_version := static_version
+	static_version = "other"
+	if changed, _ := static_stamp("a.md"); changed == stamp {
+		t.Errorf("stamp should change with static_version")
+	}
+	static_version = saved_version
+}
+
+func TestStaticBuild(t *testing.T) {
+	defer setupStaticWiki(t)()
+	if _, err := git.InitRepository(".", false); err != nil {
+		t.Fatal(err)
+	}
+	if err := save_and_commit("a.md", []byte("# hi"), "update a.md", "test"); err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(static_path("a.md"))
+	if err != nil {
+		t.Fatalf("no prebuilt page after commit: %v", err)
+	}
+	page := string(b[strings.IndexByte(string(b), '\n')+1:])
+	if !strings.Contains(page, "# hi") || !strings.Contains(page, *default_theme) {
+		t.Errorf("prebuilt page %q", page)
+	}
+	if body := get("/a", "GET").Body.String(); body != page {
+		t.Errorf("served %q, expect the prebuilt %q", body, page)
+	}
+
+	// a stale prebuilt page is rendered on the fly and rebuilt, but only on GET
+	ioutil.WriteFile("a.md.option.json", []byte(`{"Theme":"cosmo"}`), 0644)
+	if body := get("/a", "HEAD").Body.String(); !strings.Contains(body, "cosmo") {
+		t.Errorf("HEAD served %q, expect cosmo theme", body)
+	}
+	if b, _ := ioutil.ReadFile(static_path("a.md")); strings.Contains(string(b), "cosmo") {
+		t.Errorf("HEAD should not rebuild the prebuilt page")
+	}
+	if body := get("/a", "GET").Body.String(); !strings.Contains(body, "cosmo") {
+		t.Errorf("GET served %q, expect cosmo theme", body)
+	}
+	if b, _ := ioutil.ReadFile(static_path("a.md")); !strings.Contains(string(b), "cosmo") {
+		t.Errorf("GET should rebuild the prebuilt page")
+	}
+
+	// back to the old options, the page is rendered again instead of serving the cosmo one
+	os.Remove("a.md.option.json")
+	if body := get("/a", "GET").Body.String(); strings.Contains(body, "cosmo") {
+		t.Errorf("served %q after the option file is removed", body)
+	}
+}
+
+// start n goroutines rendering the same key at once, return the number of renders, the pages and errors got.
+// the render is held until every caller has arrived, so no caller can come after it finishes
+func renderConcurrently(n int, fail error) (int32, [][]byte, []error) {
+	var renders, arrived int32
+	release := make(chan struct{})
+	render := func() ([]byte, error) {
+		atomic.AddInt32(&renders, 1)
+		<-release
+		return []byte("<html>page</html>"), fail
+	}
+	key := render_cache_key([]byte("# hi"), "view", "cerulean")
+
+	pages := make([][]byte, n)
+	errs := make([]error, n)
+	gate := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			<-gate
+			atomic.AddInt32(&arrived, 1)
+			pages[i], errs[i] = render_page(key, render)
+		}(i)
+	}
+	close(gate)
+	for atomic.LoadInt32(&arrived) < int32(n) || atomic.LoadInt32(&renders) == 0 {
+		runtime.Gosched()
+	}
+	time.Sleep(10 * time.Millisecond) // let the last arrivals get from the counter into render_page
+	close(release)
+	wg.Wait()
+	return atomic.LoadInt32(&renders), pages, errs
+}
+
+func TestRenderCoalesce(t *testing.T) {
+	defer func(cache *RenderCache, coalesce bool) {
+		renderCache, *default_coalesce = cache, coalesce
+	}(renderCache, *default_coalesce)
+
+	for _, cachesize := range []int{0, 16} {
+		renderCache = nil
+		if cachesize > 0 {
+			renderCache = NewRenderCache(cachesize)
+		}
+
+		*default_coalesce = true
+		renders, pages, _ := renderConcurrently(32, nil)
+		if renders != 1 {
+			t.Errorf("cachesize %d: %d renders for concurrent identical requests, expect 1", cachesize, renders)
+		}
+		for i, page := range pages {
+			if !bytes.Equal(page, pages[0]) || len(page) == 0 {
+				t.Errorf("cachesize %d: caller %d got %q, expect %q", cachesize, i, page, pages[0])
+			}
+		}
+		if renderCache != nil && renderCache.ll.Len() != 1 {
+			t.Errorf("cachesize %d: %d cache entries, expect 1", cachesize, renderCache.ll.Len())
+		}
+	}
+
+	renderCache = nil
+	*default_coalesce = false
+	renders, pages, _ := renderConcurrently(8, nil)
+	if renders != 8 {
+		t.Errorf("%d renders with coalescing disabled, expect 8", renders)
+	}
+	for i, page := range pages {
+		if string(page) != "<html>page</html>" {
+			t.Errorf("caller %d got %q", i, page)
+		}
+	}
+}
+
+func TestRenderCoalesceError(t *testing.T) {
+	defer func(cache *RenderCache, coalesce bool) {
+		renderCache, *default_coalesce = cache, coalesce
+	}(renderCache, *default_coalesce)
+	renderCache = NewRenderCache(16)
+	*default_coalesce = true
+
+	fail := errors.New("template error")
+	renders, _, errs := renderConcurrently(16, fail)
+	if renders != 1 {
+		t.Errorf("%d renders for concurrent identical requests, expect 1", renders)
+	}
+	for i, err := range errs {
+		if err != fail {
+			t.Errorf("caller %d got error %v, expect %v", i, err, fail)
+		}
+	}
+	if renderCache.ll.Len() != 0 {
+		t.Errorf("failed render should not be cached")
+	}
+}